@@ -0,0 +1,35 @@
+package state
+
+import (
+	"github.com/layer-x/layerx-commons/lxerrors"
+)
+
+// Backend names a State implementation NewStateFromConfig can construct.
+type Backend string
+
+const (
+	// BackendMemory persists Images/Instances/Volumes/Layers as one JSON
+	// file per entity under a save directory. See memoryState.
+	BackendMemory Backend = "memory"
+	// BackendSQL persists the same entities as rows in a sqlite3 database.
+	// See sqlState.
+	BackendSQL Backend = "sql"
+)
+
+// NewStateFromConfig constructs the State backend named by backend, rooted
+// at path - a save directory for BackendMemory, a sqlite3 database file for
+// BackendSQL. An empty backend defaults to BackendMemory, the long-standing
+// behavior before BackendSQL existed. This is the one place callers should
+// go through to pick a backend rather than constructing memoryState or
+// sqlState directly, so adding a backend never requires touching more than
+// one switch.
+func NewStateFromConfig(backend Backend, path string) (State, error) {
+	switch backend {
+	case BackendMemory, "":
+		return NewMemoryState(path), nil
+	case BackendSQL:
+		return NewSQLState(path)
+	default:
+		return nil, lxerrors.New("unknown state backend "+string(backend), nil)
+	}
+}
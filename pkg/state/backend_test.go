@@ -0,0 +1,29 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestNewStateFromConfigMemoryDefault(t *testing.T) {
+	saveDir, err := ioutil.TempDir("", "unik-state-backend")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(saveDir)
+
+	s, err := NewStateFromConfig("", saveDir)
+	if err != nil {
+		t.Fatalf("NewStateFromConfig: %v", err)
+	}
+	if _, ok := s.(*memoryState); !ok {
+		t.Fatalf("expected an empty backend to default to memoryState, got %T", s)
+	}
+}
+
+func TestNewStateFromConfigUnknownBackend(t *testing.T) {
+	if _, err := NewStateFromConfig(Backend("bogus"), ""); err == nil {
+		t.Fatalf("expected an error for an unknown backend")
+	}
+}
@@ -0,0 +1,212 @@
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/emc-advanced-dev/unik/pkg/types"
+	"github.com/layer-x/layerx-commons/lxerrors"
+)
+
+const layersSubdir = "layers"
+const blobsSubdir = "blobs/sha256"
+
+// Layer is one deduplicated, content-addressed device mapping payload.
+// Several images built from the same base kernel or rootfs end up pointing
+// at the same Layer instead of each carrying their own copy of the bytes.
+type Layer struct {
+	Digest   string `json:"Digest"`
+	SizeMb   int64  `json:"SizeMb"`
+	RefCount int    `json:"RefCount"`
+}
+
+func hashDeviceMappings(deviceMappings interface{}) (string, []byte, error) {
+	data, err := json.Marshal(deviceMappings)
+	if err != nil {
+		return "", nil, lxerrors.New("marshaling device mappings", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), data, nil
+}
+
+func (s *memoryState) blobPath(digest string) string {
+	return filepath.Join(s.saveDir, blobsSubdir, digest)
+}
+
+// acquireLayer writes data to the CAS blobs directory under digest, which
+// the caller has already computed, the first time that digest is seen, and
+// increments that layer's reference count.
+// It is safe to call repeatedly for the same digest from different images.
+func (s *memoryState) acquireLayer(digest string, data []byte) error {
+	blobKey := blobsSubdir + "/" + digest
+	entry := s.fileLocks.lock(blobKey)
+	path := s.blobPath(digest)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		os.MkdirAll(filepath.Dir(path), 0751)
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			s.fileLocks.unlock(blobKey, entry)
+			return lxerrors.New("writing blob "+path, err)
+		}
+	}
+	s.fileLocks.unlock(blobKey, entry)
+
+	s.layersWriteLock.Lock()
+	defer s.layersWriteLock.Unlock()
+	old := s.getLayersRaw()
+	next := make(map[string]*Layer, len(old))
+	for d, layer := range old {
+		next[d] = layer
+	}
+	layer, ok := next[digest]
+	if !ok {
+		next[digest] = &Layer{
+			Digest:   digest,
+			SizeMb:   int64(len(data)) / (1024 * 1024),
+			RefCount: 1,
+		}
+	} else {
+		updated := *layer
+		updated.RefCount++
+		next[digest] = &updated
+	}
+	s.layersValue.Store(next)
+	s.layersDirty[digest] = true
+	return nil
+}
+
+// releaseLayer decrements digest's reference count, deleting both the blob
+// and its Layer record once nothing references it anymore.
+func (s *memoryState) releaseLayer(digest string) error {
+	s.layersWriteLock.Lock()
+	old := s.getLayersRaw()
+	layer, ok := old[digest]
+	if !ok {
+		s.layersWriteLock.Unlock()
+		return nil
+	}
+	next := make(map[string]*Layer, len(old))
+	for d, l := range old {
+		next[d] = l
+	}
+	updated := *layer
+	updated.RefCount--
+	empty := updated.RefCount <= 0
+	if empty {
+		delete(next, digest)
+	} else {
+		next[digest] = &updated
+	}
+	s.layersValue.Store(next)
+	s.layersDirty[digest] = true
+	s.layersWriteLock.Unlock()
+
+	if !empty {
+		return nil
+	}
+	blobKey := blobsSubdir + "/" + digest
+	entry := s.fileLocks.lock(blobKey)
+	defer s.fileLocks.unlock(blobKey, entry)
+	if err := os.Remove(s.blobPath(digest)); err != nil && !os.IsNotExist(err) {
+		return lxerrors.New("removing blob "+s.blobPath(digest), err)
+	}
+	return nil
+}
+
+// getLayersRaw returns the currently published Layers map as-is, sharing
+// its pointers with the published version. Like getImagesRaw, it exists
+// only for internal callers that read the published map without mutating
+// it - never return it from GetLayers.
+func (s *memoryState) getLayersRaw() map[string]*Layer {
+	return s.layersValue.Load().(map[string]*Layer)
+}
+
+// GetLayers returns a snapshot of the current layers, each a fresh copy so
+// a caller mutating an entry in place can never corrupt the published
+// state or race with a concurrent reader.
+func (s *memoryState) GetLayers() map[string]*Layer {
+	raw := s.getLayersRaw()
+	layers := make(map[string]*Layer, len(raw))
+	for digest, layer := range raw {
+		copied := *layer
+		layers[digest] = &copied
+	}
+	return layers
+}
+
+func (s *memoryState) ModifyLayers(modify func(layers map[string]*Layer) error) error {
+	s.layersWriteLock.Lock()
+	defer s.layersWriteLock.Unlock()
+
+	before := s.getLayersRaw()
+	next := make(map[string]*Layer, len(before))
+	for digest, layer := range before {
+		copied := *layer
+		next[digest] = &copied
+	}
+	if err := modify(next); err != nil {
+		return err
+	}
+	s.layersValue.Store(next)
+	markDirtyLayers(s.layersDirty, before, next)
+	return nil
+}
+
+// markDirtyLayers flags only digests that were added, removed, or whose
+// value actually changed between before and after. Compares by value, not
+// pointer, for the same reason markDirtyImages does: ModifyLayers hands the
+// caller a fresh copy of every entry, so an in-place mutation of that copy
+// must still be detected as a change.
+func markDirtyLayers(dirty map[string]bool, before, after map[string]*Layer) {
+	for digest, layer := range before {
+		other, ok := after[digest]
+		if !ok || *layer != *other {
+			dirty[digest] = true
+		}
+	}
+	for digest, layer := range after {
+		other, ok := before[digest]
+		if !ok || *layer != *other {
+			dirty[digest] = true
+		}
+	}
+}
+
+// reconcileImageLayers hashes every image's DeviceMappings, acquires a
+// Layer for each distinct digest and releases the digest previously tracked
+// for ids that disappeared or changed, so unreferenced blobs get garbage
+// collected as soon as the owning image is deleted or rebuilt.
+func (s *memoryState) reconcileImageLayers(images map[string]*types.Image) error {
+	seen := make(map[string]string)
+	for id, image := range images {
+		digest, data, err := hashDeviceMappings(image.DeviceMappings)
+		if err != nil {
+			return err
+		}
+		if s.imageLayerDigests[id] == digest {
+			seen[id] = digest
+			continue
+		}
+		if err := s.acquireLayer(digest, data); err != nil {
+			return err
+		}
+		if old, ok := s.imageLayerDigests[id]; ok {
+			if err := s.releaseLayer(old); err != nil {
+				return err
+			}
+		}
+		seen[id] = digest
+	}
+	for id, digest := range s.imageLayerDigests {
+		if _, ok := seen[id]; !ok {
+			if err := s.releaseLayer(digest); err != nil {
+				return err
+			}
+		}
+	}
+	s.imageLayerDigests = seen
+	return nil
+}
@@ -0,0 +1,69 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/emc-advanced-dev/unik/pkg/types"
+)
+
+func TestReconcileImageLayersSharedDigestIsRefCounted(t *testing.T) {
+	saveDir, err := ioutil.TempDir("", "unik-layer-store")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(saveDir)
+
+	s := NewMemoryState(saveDir)
+	deviceMappings := []types.DeviceMapping{{MountPoint: "/", Path: "/dev/sda"}}
+
+	if err := s.ModifyImages(func(images map[string]*types.Image) error {
+		images["a"] = &types.Image{Id: "a", DeviceMappings: deviceMappings}
+		images["b"] = &types.Image{Id: "b", DeviceMappings: deviceMappings}
+		return nil
+	}); err != nil {
+		t.Fatalf("seeding images: %v", err)
+	}
+
+	digest, _, err := hashDeviceMappings(deviceMappings)
+	if err != nil {
+		t.Fatalf("hashDeviceMappings: %v", err)
+	}
+	layer, ok := s.GetLayers()[digest]
+	if !ok {
+		t.Fatalf("expected layer for shared digest to exist")
+	}
+	if layer.RefCount != 2 {
+		t.Fatalf("RefCount = %d, want 2 for two images sharing a digest", layer.RefCount)
+	}
+
+	if err := s.ModifyImages(func(images map[string]*types.Image) error {
+		delete(images, "a")
+		return nil
+	}); err != nil {
+		t.Fatalf("removing image a: %v", err)
+	}
+
+	layer, ok = s.GetLayers()[digest]
+	if !ok {
+		t.Fatalf("layer should still exist while image b references it")
+	}
+	if layer.RefCount != 1 {
+		t.Fatalf("RefCount = %d, want 1 after releasing one of two references", layer.RefCount)
+	}
+
+	if err := s.ModifyImages(func(images map[string]*types.Image) error {
+		delete(images, "b")
+		return nil
+	}); err != nil {
+		t.Fatalf("removing image b: %v", err)
+	}
+
+	if _, ok := s.GetLayers()[digest]; ok {
+		t.Fatalf("layer should have been released once its last reference was removed")
+	}
+	if _, err := os.Stat(s.blobPath(digest)); !os.IsNotExist(err) {
+		t.Fatalf("expected blob to be removed once the layer was released")
+	}
+}
@@ -0,0 +1,255 @@
+package state
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/emc-advanced-dev/unik/pkg/types"
+	"github.com/layer-x/layerx-commons/lxerrors"
+)
+
+// currentSchemaVersion is the schema version written by this build. Bump it
+// and append a migration to each affected chain whenever types.Image,
+// types.Instance, types.Volume or Layer changes shape in a way that would
+// otherwise corrupt or silently drop data from an older save directory.
+const currentSchemaVersion = 3
+
+const schemaVersionFile = "schema_version.json"
+
+type schemaVersionDoc struct {
+	SchemaVersion int `json:"SchemaVersion"`
+}
+
+// migrationFunc upgrades one entity's raw json by exactly one schema
+// version. migrations[v] is applied to a file last written at version v,
+// producing one written at v+1. saveDir is passed through so a migration
+// that needs to write alongside the entity it's upgrading - such as
+// backfilling a CAS blob - can do so without a separate pass over the
+// directory.
+type migrationFunc func(saveDir string, raw json.RawMessage) (json.RawMessage, error)
+
+func identityMigration(saveDir string, raw json.RawMessage) (json.RawMessage, error) {
+	return raw, nil
+}
+
+// migrateImageV0toV1 anchors schema version 1: save directories written
+// before SchemaVersion tracking existed are treated as v0, and this
+// migration is the no-op that tags them as v1 going forward.
+func migrateImageV0toV1(saveDir string, raw json.RawMessage) (json.RawMessage, error) {
+	return raw, nil
+}
+
+// migrateImageV1toV2 accompanies the introduction of the content-addressable
+// layer store: images kept their DeviceMappings stored inline at this
+// version, so there is nothing to rewrite here. migrateImageV2toV3 below is
+// what moves DeviceMappings out into the CAS blob store.
+func migrateImageV1toV2(saveDir string, raw json.RawMessage) (json.RawMessage, error) {
+	return raw, nil
+}
+
+// legacyImageV2 is the pre-v3 on-disk shape for images: DeviceMappings
+// stored inline rather than referenced by LayerDigest.
+type legacyImageV2 struct {
+	Id             string
+	Name           string
+	DeviceMappings []types.DeviceMapping
+	SizeMb         int64
+	Infrastructure string
+	Created        int64
+}
+
+// migrateImageV2toV3 accompanies splitting the on-disk image shape into
+// imageRecord: DeviceMappings move out of the per-image file and into the
+// content-addressed blob store, referenced by LayerDigest. It hashes the
+// inline DeviceMappings it finds, acquires a layer for that digest directly
+// on disk (the in-memory layersValue isn't built yet at Load time), and
+// rewrites the file to the new record shape.
+//
+// It is idempotent: writeSchemaVersion only runs once, after every subdir
+// has been migrated, so a process killed mid-Load can leave some image
+// files already rewritten to the v3 shape while schema_version.json still
+// reads 2, and the next Load will run this migration over them again. A
+// file with no DeviceMappings key has already been migrated - return it
+// unchanged rather than reinterpreting it as legacy and hashing a nil slice,
+// which would silently replace its real LayerDigest with the digest of nil.
+func migrateImageV2toV3(saveDir string, raw json.RawMessage) (json.RawMessage, error) {
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &probe); err != nil {
+		return nil, lxerrors.New("probing image shape", err)
+	}
+	if _, legacyShape := probe["DeviceMappings"]; !legacyShape {
+		return raw, nil
+	}
+
+	var legacy legacyImageV2
+	if err := json.Unmarshal(raw, &legacy); err != nil {
+		return nil, lxerrors.New("unmarshaling legacy image", err)
+	}
+	digest, data, err := hashDeviceMappings(legacy.DeviceMappings)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrationAcquireLayer(saveDir, digest, data); err != nil {
+		return nil, err
+	}
+	record := imageRecord{
+		Id:             legacy.Id,
+		Name:           legacy.Name,
+		LayerDigest:    digest,
+		SizeMb:         legacy.SizeMb,
+		Infrastructure: legacy.Infrastructure,
+		Created:        legacy.Created,
+	}
+	migrated, err := json.Marshal(&record)
+	if err != nil {
+		return nil, lxerrors.New("marshaling migrated image", err)
+	}
+	return migrated, nil
+}
+
+// migrationAcquireLayer writes digest's blob if it isn't already on disk
+// and increments (or creates) its persisted Layer record directly, without
+// going through a memoryState's atomic.Value bookkeeping - migrations run
+// before any memoryState has loaded the layers they touch.
+func migrationAcquireLayer(saveDir, digest string, data []byte) error {
+	blobPath := filepath.Join(saveDir, blobsSubdir, digest)
+	if _, err := os.Stat(blobPath); os.IsNotExist(err) {
+		os.MkdirAll(filepath.Dir(blobPath), 0751)
+		if err := ioutil.WriteFile(blobPath, data, 0644); err != nil {
+			return lxerrors.New("writing blob "+blobPath, err)
+		}
+	}
+
+	layerPath := entityFile(saveDir, layersSubdir, digest)
+	var layer Layer
+	existing, err := ioutil.ReadFile(layerPath)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(existing, &layer); err != nil {
+			return lxerrors.New("unmarshaling layer "+digest, err)
+		}
+	case os.IsNotExist(err):
+		layer = Layer{Digest: digest, SizeMb: int64(len(data)) / (1024 * 1024)}
+	default:
+		return lxerrors.New("reading "+layerPath, err)
+	}
+	layer.RefCount++
+	marshaled, err := json.Marshal(&layer)
+	if err != nil {
+		return lxerrors.New("marshaling layer "+digest, err)
+	}
+	os.MkdirAll(filepath.Dir(layerPath), 0751)
+	if err := ioutil.WriteFile(layerPath, marshaled, 0644); err != nil {
+		return lxerrors.New("writing "+layerPath, err)
+	}
+	return nil
+}
+
+var imageMigrations = []migrationFunc{
+	migrateImageV0toV1,
+	migrateImageV1toV2,
+	migrateImageV2toV3,
+}
+
+var instanceMigrations = []migrationFunc{
+	identityMigration,
+	identityMigration,
+	identityMigration,
+}
+
+var volumeMigrations = []migrationFunc{
+	identityMigration,
+	identityMigration,
+	identityMigration,
+}
+
+var layerMigrations = []migrationFunc{
+	identityMigration,
+	identityMigration,
+	identityMigration,
+}
+
+// applyMigrations runs every migration from fromVersion up to
+// currentSchemaVersion over raw, in order.
+func applyMigrations(migrations []migrationFunc, fromVersion int, saveDir string, raw json.RawMessage) (json.RawMessage, error) {
+	for v := fromVersion; v < len(migrations); v++ {
+		migrated, err := migrations[v](saveDir, raw)
+		if err != nil {
+			return nil, lxerrors.New("running migration", err)
+		}
+		raw = migrated
+	}
+	return raw, nil
+}
+
+func readSchemaVersion(saveDir string) (int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(saveDir, schemaVersionFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, lxerrors.New("reading "+schemaVersionFile, err)
+	}
+	var doc schemaVersionDoc
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return 0, lxerrors.New("unmarshaling "+schemaVersionFile, err)
+	}
+	return doc.SchemaVersion, nil
+}
+
+func writeSchemaVersion(saveDir string, version int) error {
+	data, err := json.Marshal(schemaVersionDoc{SchemaVersion: version})
+	if err != nil {
+		return lxerrors.New("marshaling "+schemaVersionFile, err)
+	}
+	os.MkdirAll(saveDir, 0751)
+	if err := ioutil.WriteFile(filepath.Join(saveDir, schemaVersionFile), data, 0644); err != nil {
+		return lxerrors.New("writing "+schemaVersionFile, err)
+	}
+	return nil
+}
+
+// loadDirMigrated walks <saveDir>/<subdir> like loadDir, but first runs
+// each file's contents through migrations starting at fromVersion, writing
+// the upgraded blob back atomically whenever a migration actually changed
+// it, before handing the (now current-version) bytes to unmarshalInto.
+func loadDirMigrated(saveDir, subdir string, fromVersion int, migrations []migrationFunc, unmarshalInto func(id string, data []byte) error) error {
+	dir := filepath.Join(saveDir, subdir)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return lxerrors.New("reading "+dir, err)
+	}
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), ".json") {
+			continue
+		}
+		id := strings.TrimSuffix(info.Name(), ".json")
+		path := filepath.Join(dir, info.Name())
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return lxerrors.New("reading "+info.Name(), err)
+		}
+		migrated, err := applyMigrations(migrations, fromVersion, saveDir, json.RawMessage(data))
+		if err != nil {
+			return lxerrors.New("migrating "+info.Name(), err)
+		}
+		if string(migrated) != string(data) {
+			if err := ioutil.WriteFile(path+".tmp", migrated, 0644); err != nil {
+				return lxerrors.New("writing migrated "+path, err)
+			}
+			if err := os.Rename(path+".tmp", path); err != nil {
+				return lxerrors.New("replacing migrated "+path, err)
+			}
+		}
+		if err := unmarshalInto(id, migrated); err != nil {
+			return err
+		}
+	}
+	return nil
+}
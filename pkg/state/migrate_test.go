@@ -0,0 +1,220 @@
+package state
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/emc-advanced-dev/unik/pkg/types"
+)
+
+func TestMigrateImageV2toV3BackfillsLayer(t *testing.T) {
+	saveDir, err := ioutil.TempDir("", "unik-state-migrate")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(saveDir)
+
+	legacy := legacyImageV2{
+		Id:   "img-1",
+		Name: "my-image",
+		DeviceMappings: []types.DeviceMapping{
+			{MountPoint: "/", Path: "/dev/sda"},
+		},
+		SizeMb:         42,
+		Infrastructure: "aws",
+		Created:        1234,
+	}
+	raw, err := json.Marshal(&legacy)
+	if err != nil {
+		t.Fatalf("marshaling legacy image: %v", err)
+	}
+
+	migrated, err := migrateImageV2toV3(saveDir, raw)
+	if err != nil {
+		t.Fatalf("migrateImageV2toV3: %v", err)
+	}
+
+	var record imageRecord
+	if err := json.Unmarshal(migrated, &record); err != nil {
+		t.Fatalf("unmarshaling migrated record: %v", err)
+	}
+	if record.Id != legacy.Id || record.Name != legacy.Name {
+		t.Fatalf("migrated record lost fields: %+v", record)
+	}
+	if record.LayerDigest == "" {
+		t.Fatalf("migrated record has no LayerDigest")
+	}
+
+	wantDigest, wantData, err := hashDeviceMappings(legacy.DeviceMappings)
+	if err != nil {
+		t.Fatalf("hashDeviceMappings: %v", err)
+	}
+	if record.LayerDigest != wantDigest {
+		t.Fatalf("LayerDigest = %q, want %q", record.LayerDigest, wantDigest)
+	}
+
+	blobData, err := ioutil.ReadFile(filepath.Join(saveDir, blobsSubdir, wantDigest))
+	if err != nil {
+		t.Fatalf("reading backfilled blob: %v", err)
+	}
+	if string(blobData) != string(wantData) {
+		t.Fatalf("backfilled blob contents don't match hashed DeviceMappings")
+	}
+
+	layerData, err := ioutil.ReadFile(entityFile(saveDir, layersSubdir, wantDigest))
+	if err != nil {
+		t.Fatalf("reading backfilled layer record: %v", err)
+	}
+	var layer Layer
+	if err := json.Unmarshal(layerData, &layer); err != nil {
+		t.Fatalf("unmarshaling backfilled layer record: %v", err)
+	}
+	if layer.RefCount != 1 {
+		t.Fatalf("RefCount = %d, want 1", layer.RefCount)
+	}
+}
+
+func TestMigrationAcquireLayerSharedDigestIncrementsRefCount(t *testing.T) {
+	saveDir, err := ioutil.TempDir("", "unik-state-migrate")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(saveDir)
+
+	digest, data, err := hashDeviceMappings([]types.DeviceMapping{{MountPoint: "/", Path: "/dev/sda"}})
+	if err != nil {
+		t.Fatalf("hashDeviceMappings: %v", err)
+	}
+
+	if err := migrationAcquireLayer(saveDir, digest, data); err != nil {
+		t.Fatalf("first migrationAcquireLayer: %v", err)
+	}
+	if err := migrationAcquireLayer(saveDir, digest, data); err != nil {
+		t.Fatalf("second migrationAcquireLayer: %v", err)
+	}
+
+	layerData, err := ioutil.ReadFile(entityFile(saveDir, layersSubdir, digest))
+	if err != nil {
+		t.Fatalf("reading layer record: %v", err)
+	}
+	var layer Layer
+	if err := json.Unmarshal(layerData, &layer); err != nil {
+		t.Fatalf("unmarshaling layer record: %v", err)
+	}
+	if layer.RefCount != 2 {
+		t.Fatalf("RefCount = %d, want 2", layer.RefCount)
+	}
+}
+
+func TestLoadMigratesLegacyImageAndHydratesDeviceMappings(t *testing.T) {
+	saveDir, err := ioutil.TempDir("", "unik-state-load")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(saveDir)
+
+	legacy := legacyImageV2{
+		Id:   "img-1",
+		Name: "my-image",
+		DeviceMappings: []types.DeviceMapping{
+			{MountPoint: "/", Path: "/dev/sda"},
+		},
+		SizeMb:         7,
+		Infrastructure: "aws",
+		Created:        99,
+	}
+	raw, err := json.Marshal(&legacy)
+	if err != nil {
+		t.Fatalf("marshaling legacy image: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(saveDir, imagesSubdir), 0751); err != nil {
+		t.Fatalf("creating images subdir: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(saveDir, imagesSubdir, legacy.Id+".json"), raw, 0644); err != nil {
+		t.Fatalf("writing legacy image file: %v", err)
+	}
+	if err := writeSchemaVersion(saveDir, 2); err != nil {
+		t.Fatalf("writing legacy schema version: %v", err)
+	}
+
+	s := NewMemoryState(saveDir)
+	if err := s.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	image, ok := s.GetImages()[legacy.Id]
+	if !ok {
+		t.Fatalf("migrated image %q not found after Load", legacy.Id)
+	}
+	if len(image.DeviceMappings) != 1 || image.DeviceMappings[0] != legacy.DeviceMappings[0] {
+		t.Fatalf("DeviceMappings not hydrated correctly: %+v", image.DeviceMappings)
+	}
+
+	version, err := readSchemaVersion(saveDir)
+	if err != nil {
+		t.Fatalf("readSchemaVersion: %v", err)
+	}
+	if version != currentSchemaVersion {
+		t.Fatalf("schema version = %d, want %d", version, currentSchemaVersion)
+	}
+}
+
+// TestLoadSurvivesCrashBetweenMigrationAndSchemaVersionBump simulates a
+// process killed after an image file was rewritten to the v3 imageRecord
+// shape but before writeSchemaVersion could record the bump, so the next
+// Load sees schema_version.json still at 2 and reruns migrateImageV2toV3
+// over an already-migrated file. That rerun must leave DeviceMappings and
+// LayerDigest alone rather than reinterpreting the record as legacy and
+// hashing its absent DeviceMappings field to null.
+func TestLoadSurvivesCrashBetweenMigrationAndSchemaVersionBump(t *testing.T) {
+	saveDir, err := ioutil.TempDir("", "unik-state-load")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(saveDir)
+
+	deviceMappings := []types.DeviceMapping{{MountPoint: "/", Path: "/dev/sda"}}
+	digest, data, err := hashDeviceMappings(deviceMappings)
+	if err != nil {
+		t.Fatalf("hashDeviceMappings: %v", err)
+	}
+	if err := migrationAcquireLayer(saveDir, digest, data); err != nil {
+		t.Fatalf("migrationAcquireLayer: %v", err)
+	}
+
+	record := imageRecord{Id: "img-1", Name: "my-image", LayerDigest: digest, SizeMb: 7}
+	raw, err := json.Marshal(&record)
+	if err != nil {
+		t.Fatalf("marshaling already-migrated record: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(saveDir, imagesSubdir), 0751); err != nil {
+		t.Fatalf("creating images subdir: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(saveDir, imagesSubdir, record.Id+".json"), raw, 0644); err != nil {
+		t.Fatalf("writing already-migrated image file: %v", err)
+	}
+	// schema_version.json was never bumped past 2, as if Load crashed right
+	// after rewriting the image file.
+	if err := writeSchemaVersion(saveDir, 2); err != nil {
+		t.Fatalf("writing stale schema version: %v", err)
+	}
+
+	s := NewMemoryState(saveDir)
+	if err := s.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	image, ok := s.GetImages()[record.Id]
+	if !ok {
+		t.Fatalf("image %q not found after re-running Load", record.Id)
+	}
+	if len(image.DeviceMappings) != 1 || image.DeviceMappings[0] != deviceMappings[0] {
+		t.Fatalf("DeviceMappings were lost on a repeated migration pass: %+v", image.DeviceMappings)
+	}
+	if s.imageLayerDigests[record.Id] != digest {
+		t.Fatalf("LayerDigest changed on a repeated migration pass: got %q, want %q", s.imageLayerDigests[record.Id], digest)
+	}
+}
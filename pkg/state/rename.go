@@ -0,0 +1,239 @@
+package state
+
+import (
+	"github.com/emc-advanced-dev/unik/pkg/types"
+	"github.com/layer-x/layerx-commons/lxerrors"
+)
+
+// RenameImage renames the image identified by id to newName, failing if
+// another image already has that name.
+func (s *memoryState) RenameImage(id, newName string) error {
+	return s.ModifyImages(func(images map[string]*types.Image) error {
+		image, ok := images[id]
+		if !ok {
+			return lxerrors.New("no image found with id "+id, nil)
+		}
+		for otherId, other := range images {
+			if otherId != id && other.Name == newName {
+				return lxerrors.New("image already exists with name "+newName, nil)
+			}
+		}
+		renamed := *image
+		renamed.Name = newName
+		images[id] = &renamed
+		return nil
+	})
+}
+
+// RenameInstance renames the instance identified by id to newName, failing
+// if another instance already has that name. Any volume attached to this
+// instance has its Attachment updated to the new name so the reference
+// stays valid. The instance rename and every volume patch publish under a
+// single critical section spanning both instancesWriteLock and
+// volumesWriteLock - going through ModifyInstances then ModifyVolumes as
+// two separate calls would let a concurrent rename reuse the old instance
+// name in between them and have its volume wrongly re-attached here.
+// Always acquire instancesWriteLock before volumesWriteLock, since that's
+// the only order this package takes both locks in.
+func (s *memoryState) RenameInstance(id, newName string) error {
+	s.instancesWriteLock.Lock()
+	defer s.instancesWriteLock.Unlock()
+	s.volumesWriteLock.Lock()
+	defer s.volumesWriteLock.Unlock()
+
+	beforeInstances := s.getInstancesRaw()
+	instance, ok := beforeInstances[id]
+	if !ok {
+		return lxerrors.New("no instance found with id "+id, nil)
+	}
+	for otherId, other := range beforeInstances {
+		if otherId != id && other.Name == newName {
+			return lxerrors.New("instance already exists with name "+newName, nil)
+		}
+	}
+	oldName := instance.Name
+
+	nextInstances := make(map[string]*types.Instance, len(beforeInstances))
+	for otherId, other := range beforeInstances {
+		copied := *other
+		nextInstances[otherId] = &copied
+	}
+	renamedInstance := *instance
+	renamedInstance.Name = newName
+	nextInstances[id] = &renamedInstance
+
+	beforeVolumes := s.getVolumesRaw()
+	nextVolumes := make(map[string]*types.Volume, len(beforeVolumes))
+	for volumeId, volume := range beforeVolumes {
+		copied := *volume
+		if copied.Attachment == oldName {
+			copied.Attachment = newName
+		}
+		nextVolumes[volumeId] = &copied
+	}
+
+	s.instancesValue.Store(nextInstances)
+	markDirtyInstances(s.instancesDirty, beforeInstances, nextInstances)
+	s.volumesValue.Store(nextVolumes)
+	markDirtyVolumes(s.volumesDirty, beforeVolumes, nextVolumes)
+	return nil
+}
+
+// RenameVolume renames the volume identified by id to newName, failing if
+// another volume already has that name.
+func (s *memoryState) RenameVolume(id, newName string) error {
+	return s.ModifyVolumes(func(volumes map[string]*types.Volume) error {
+		volume, ok := volumes[id]
+		if !ok {
+			return lxerrors.New("no volume found with id "+id, nil)
+		}
+		for otherId, other := range volumes {
+			if otherId != id && other.Name == newName {
+				return lxerrors.New("volume already exists with name "+newName, nil)
+			}
+		}
+		renamed := *volume
+		renamed.Name = newName
+		volumes[id] = &renamed
+		return nil
+	})
+}
+
+// RenameImage renames the image identified by id to newName, failing if
+// another image already has that name.
+func (s *sqlState) RenameImage(id, newName string) error {
+	s.dbLock.Lock()
+	defer s.dbLock.Unlock()
+	images, err := s.getAll("images")
+	if err != nil {
+		return err
+	}
+	raw, ok := images[id]
+	if !ok {
+		return lxerrors.New("no image found with id "+id, nil)
+	}
+	for otherId, data := range images {
+		if otherId == id {
+			continue
+		}
+		var other sqlImageRecord
+		if err := jsonUnmarshal(data, &other); err != nil {
+			return err
+		}
+		if other.Name == newName {
+			return lxerrors.New("image already exists with name "+newName, nil)
+		}
+	}
+	var record sqlImageRecord
+	if err := jsonUnmarshal(raw, &record); err != nil {
+		return err
+	}
+	record.Name = newName
+	return writeRow(s, "images", id, &record)
+}
+
+// RenameInstance renames the instance identified by id to newName, failing
+// if another instance already has that name, and patches any volume
+// Attachment that pointed at the instance's old name. The instance rename
+// and every volume patch commit as one transaction, so a crash partway
+// through can never leave a volume Attachment pointing at a name no
+// instance has anymore.
+func (s *sqlState) RenameInstance(id, newName string) error {
+	s.dbLock.Lock()
+	defer s.dbLock.Unlock()
+	instancesRaw, err := s.getAll("instances")
+	if err != nil {
+		return err
+	}
+	raw, ok := instancesRaw[id]
+	if !ok {
+		return lxerrors.New("no instance found with id "+id, nil)
+	}
+	for otherId, data := range instancesRaw {
+		if otherId == id {
+			continue
+		}
+		var other types.Instance
+		if err := jsonUnmarshal(data, &other); err != nil {
+			return err
+		}
+		if other.Name == newName {
+			return lxerrors.New("instance already exists with name "+newName, nil)
+		}
+	}
+	var instance types.Instance
+	if err := jsonUnmarshal(raw, &instance); err != nil {
+		return err
+	}
+	oldName := instance.Name
+	instance.Name = newName
+
+	volumesRaw, err := s.getAll("volumes")
+	if err != nil {
+		return err
+	}
+	touchedVolumes := make(map[string]*types.Volume)
+	for volumeId, data := range volumesRaw {
+		var volume types.Volume
+		if err := jsonUnmarshal(data, &volume); err != nil {
+			return err
+		}
+		if volume.Attachment != oldName {
+			continue
+		}
+		volume.Attachment = newName
+		touchedVolumes[volumeId] = &volume
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return lxerrors.New("beginning transaction renaming instance "+id, err)
+	}
+	if err := writeRowTx(tx, "instances", id, &instance); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for volumeId, volume := range touchedVolumes {
+		if err := writeRowTx(tx, "volumes", volumeId, volume); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return lxerrors.New("committing instance rename for "+id, err)
+	}
+	return nil
+}
+
+// RenameVolume renames the volume identified by id to newName, failing if
+// another volume already has that name.
+func (s *sqlState) RenameVolume(id, newName string) error {
+	s.dbLock.Lock()
+	defer s.dbLock.Unlock()
+	volumes, err := s.getAll("volumes")
+	if err != nil {
+		return err
+	}
+	raw, ok := volumes[id]
+	if !ok {
+		return lxerrors.New("no volume found with id "+id, nil)
+	}
+	for otherId, data := range volumes {
+		if otherId == id {
+			continue
+		}
+		var other types.Volume
+		if err := jsonUnmarshal(data, &other); err != nil {
+			return err
+		}
+		if other.Name == newName {
+			return lxerrors.New("volume already exists with name "+newName, nil)
+		}
+	}
+	var volume types.Volume
+	if err := jsonUnmarshal(raw, &volume); err != nil {
+		return err
+	}
+	volume.Name = newName
+	return writeRow(s, "volumes", id, &volume)
+}
@@ -0,0 +1,65 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/emc-advanced-dev/unik/pkg/types"
+)
+
+func newTestMemoryState(t *testing.T) *memoryState {
+	saveDir, err := ioutil.TempDir("", "unik-state-rename")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(saveDir) })
+	return NewMemoryState(saveDir)
+}
+
+func TestRenameInstancePatchesVolumeAttachment(t *testing.T) {
+	s := newTestMemoryState(t)
+
+	if err := s.ModifyInstances(func(instances map[string]*types.Instance) error {
+		instances["i1"] = &types.Instance{Id: "i1", Name: "old-name"}
+		return nil
+	}); err != nil {
+		t.Fatalf("seeding instance: %v", err)
+	}
+	if err := s.ModifyVolumes(func(volumes map[string]*types.Volume) error {
+		volumes["v1"] = &types.Volume{Id: "v1", Name: "v1", Attachment: "old-name"}
+		return nil
+	}); err != nil {
+		t.Fatalf("seeding volume: %v", err)
+	}
+
+	if err := s.RenameInstance("i1", "new-name"); err != nil {
+		t.Fatalf("RenameInstance: %v", err)
+	}
+
+	if s.GetInstances()["i1"].Name != "new-name" {
+		t.Fatalf("instance was not renamed")
+	}
+	if s.GetVolumes()["v1"].Attachment != "new-name" {
+		t.Fatalf("volume Attachment was not patched to follow the rename")
+	}
+}
+
+func TestRenameInstanceRejectsDuplicateName(t *testing.T) {
+	s := newTestMemoryState(t)
+
+	if err := s.ModifyInstances(func(instances map[string]*types.Instance) error {
+		instances["i1"] = &types.Instance{Id: "i1", Name: "one"}
+		instances["i2"] = &types.Instance{Id: "i2", Name: "two"}
+		return nil
+	}); err != nil {
+		t.Fatalf("seeding instances: %v", err)
+	}
+
+	if err := s.RenameInstance("i1", "two"); err == nil {
+		t.Fatalf("expected an error renaming to an already-taken name")
+	}
+	if s.GetInstances()["i1"].Name != "one" {
+		t.Fatalf("instance name changed despite rejected rename")
+	}
+}
@@ -0,0 +1,541 @@
+package state
+
+import (
+	"database/sql"
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/emc-advanced-dev/unik/pkg/types"
+	"github.com/layer-x/layerx-commons/lxerrors"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqlSchema = `
+CREATE TABLE IF NOT EXISTS images (id TEXT PRIMARY KEY, data TEXT NOT NULL);
+CREATE TABLE IF NOT EXISTS instances (id TEXT PRIMARY KEY, data TEXT NOT NULL);
+CREATE TABLE IF NOT EXISTS volumes (id TEXT PRIMARY KEY, data TEXT NOT NULL);
+CREATE TABLE IF NOT EXISTS layers (id TEXT PRIMARY KEY, data TEXT NOT NULL);
+CREATE TABLE IF NOT EXISTS blobs (digest TEXT PRIMARY KEY, data TEXT NOT NULL);
+`
+
+// sqlImageRecord is the row shape stored in the images table. Like
+// memoryState's imageRecord, it omits DeviceMappings - that payload lives
+// once in the blobs table, keyed by LayerDigest - so the SQL backend
+// deduplicates device mapping payloads the same way the file backend does.
+type sqlImageRecord struct {
+	Id             string
+	Name           string
+	LayerDigest    string
+	SizeMb         int64
+	Infrastructure string
+	Created        int64
+}
+
+// sqlState is a State implementation that persists Images/Instances/Volumes
+// as one row per entity in a sqlite3 database, rather than a single JSON
+// blob. Modify* calls are wrapped in a sql transaction, so a crash mid-write
+// can only lose the in-flight mutation, never the whole store.
+type sqlState struct {
+	dbLock sync.Mutex
+	db     *sql.DB
+	dbPath string
+}
+
+// NewSQLState opens (creating if necessary) a sqlite3 database at dbPath and
+// returns a State backed by it.
+func NewSQLState(dbPath string) (*sqlState, error) {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, lxerrors.New("opening sqlite database "+dbPath, err)
+	}
+	s := &sqlState{
+		db:     db,
+		dbPath: dbPath,
+	}
+	if _, err := s.db.Exec(sqlSchema); err != nil {
+		return nil, lxerrors.New("creating sqlite schema", err)
+	}
+	return s, nil
+}
+
+func (s *sqlState) getAll(table string) (map[string]json.RawMessage, error) {
+	rows, err := s.db.Query("SELECT id, data FROM " + table)
+	if err != nil {
+		return nil, lxerrors.New("querying "+table, err)
+	}
+	defer rows.Close()
+	result := make(map[string]json.RawMessage)
+	for rows.Next() {
+		var id, data string
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, lxerrors.New("scanning row from "+table, err)
+		}
+		result[id] = json.RawMessage(data)
+	}
+	return result, nil
+}
+
+// loadDeviceMappings reads digest's blob back from the blobs table and
+// unmarshals it into the DeviceMappings slice that was hashed to produce
+// it. An empty digest yields nil rather than an error.
+func (s *sqlState) loadDeviceMappings(digest string) ([]types.DeviceMapping, error) {
+	if digest == "" {
+		return nil, nil
+	}
+	row := s.db.QueryRow("SELECT data FROM blobs WHERE digest = ?", digest)
+	var data string
+	if err := row.Scan(&data); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, lxerrors.New("reading blob "+digest, err)
+	}
+	var deviceMappings []types.DeviceMapping
+	if err := json.Unmarshal([]byte(data), &deviceMappings); err != nil {
+		return nil, lxerrors.New("unmarshaling device mappings for "+digest, err)
+	}
+	return deviceMappings, nil
+}
+
+func (s *sqlState) imageFromRecord(record *sqlImageRecord) (*types.Image, error) {
+	deviceMappings, err := s.loadDeviceMappings(record.LayerDigest)
+	if err != nil {
+		return nil, err
+	}
+	return &types.Image{
+		Id:             record.Id,
+		Name:           record.Name,
+		DeviceMappings: deviceMappings,
+		SizeMb:         record.SizeMb,
+		Infrastructure: record.Infrastructure,
+		Created:        record.Created,
+	}, nil
+}
+
+func (s *sqlState) GetImages() map[string]*types.Image {
+	s.dbLock.Lock()
+	defer s.dbLock.Unlock()
+	images := make(map[string]*types.Image)
+	raw, err := s.getAll("images")
+	if err != nil {
+		return images
+	}
+	for id, data := range raw {
+		var record sqlImageRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			continue
+		}
+		image, err := s.imageFromRecord(&record)
+		if err != nil {
+			continue
+		}
+		images[id] = image
+	}
+	return images
+}
+
+func (s *sqlState) GetInstances() map[string]*types.Instance {
+	s.dbLock.Lock()
+	defer s.dbLock.Unlock()
+	instances := make(map[string]*types.Instance)
+	raw, err := s.getAll("instances")
+	if err != nil {
+		return instances
+	}
+	for id, data := range raw {
+		var instance types.Instance
+		if err := json.Unmarshal(data, &instance); err != nil {
+			continue
+		}
+		instances[id] = &instance
+	}
+	return instances
+}
+
+func (s *sqlState) GetVolumes() map[string]*types.Volume {
+	s.dbLock.Lock()
+	defer s.dbLock.Unlock()
+	volumes := make(map[string]*types.Volume)
+	raw, err := s.getAll("volumes")
+	if err != nil {
+		return volumes
+	}
+	for id, data := range raw {
+		var volume types.Volume
+		if err := json.Unmarshal(data, &volume); err != nil {
+			continue
+		}
+		volumes[id] = &volume
+	}
+	return volumes
+}
+
+func (s *sqlState) GetLayers() map[string]*Layer {
+	s.dbLock.Lock()
+	defer s.dbLock.Unlock()
+	layers := make(map[string]*Layer)
+	raw, err := s.getAll("layers")
+	if err != nil {
+		return layers
+	}
+	for digest, data := range raw {
+		var layer Layer
+		if err := json.Unmarshal(data, &layer); err != nil {
+			continue
+		}
+		layers[digest] = &layer
+	}
+	return layers
+}
+
+func (s *sqlState) ModifyLayers(modify func(layers map[string]*Layer) error) error {
+	s.dbLock.Lock()
+	defer s.dbLock.Unlock()
+	before, err := s.getAll("layers")
+	if err != nil {
+		return err
+	}
+	layers := make(map[string]*Layer)
+	for digest, data := range before {
+		var layer Layer
+		if err := json.Unmarshal(data, &layer); err != nil {
+			return lxerrors.New("unmarshaling layer "+digest, err)
+		}
+		layers[digest] = &layer
+	}
+	if err := modify(layers); err != nil {
+		return err
+	}
+	after := make(map[string]interface{})
+	for digest, layer := range layers {
+		after[digest] = layer
+	}
+	return modifyTable(s, "layers", before, after)
+}
+
+func jsonUnmarshal(raw json.RawMessage, dest interface{}) error {
+	if err := json.Unmarshal(raw, dest); err != nil {
+		return lxerrors.New("unmarshaling row", err)
+	}
+	return nil
+}
+
+// writeRow persists a single row in a one-statement transaction, used by
+// Rename* methods that only ever touch one row and have no other statement
+// to keep it atomic with.
+func writeRow(s *sqlState, table, id string, entity interface{}) error {
+	data, err := json.Marshal(entity)
+	if err != nil {
+		return lxerrors.New("marshaling "+id+" for "+table, err)
+	}
+	if _, err := s.db.Exec("INSERT OR REPLACE INTO "+table+" (id, data) VALUES (?, ?)", id, string(data)); err != nil {
+		return lxerrors.New("writing "+id+" to "+table, err)
+	}
+	return nil
+}
+
+// writeRowTx is writeRow's tx-scoped counterpart, used by Rename* methods
+// that must commit several row writes atomically.
+func writeRowTx(tx *sql.Tx, table, id string, entity interface{}) error {
+	data, err := json.Marshal(entity)
+	if err != nil {
+		return lxerrors.New("marshaling "+id+" for "+table, err)
+	}
+	if _, err := tx.Exec("INSERT OR REPLACE INTO "+table+" (id, data) VALUES (?, ?)", id, string(data)); err != nil {
+		return lxerrors.New("writing "+id+" to "+table, err)
+	}
+	return nil
+}
+
+// modifyTable diffs after, the result of a caller's modify, against before,
+// the rows that were read, and writes only the rows that were added,
+// changed or removed, all inside a single transaction.
+func modifyTable(s *sqlState, table string, before map[string]json.RawMessage, after map[string]interface{}) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return lxerrors.New("beginning transaction on "+table, err)
+	}
+	for id := range before {
+		if _, ok := after[id]; !ok {
+			if _, err := tx.Exec("DELETE FROM "+table+" WHERE id = ?", id); err != nil {
+				tx.Rollback()
+				return lxerrors.New("deleting "+id+" from "+table, err)
+			}
+		}
+	}
+	for id, entity := range after {
+		data, err := json.Marshal(entity)
+		if err != nil {
+			tx.Rollback()
+			return lxerrors.New("marshaling "+id+" for "+table, err)
+		}
+		if old, ok := before[id]; ok && string(old) == string(data) {
+			continue
+		}
+		if _, err := tx.Exec("INSERT OR REPLACE INTO "+table+" (id, data) VALUES (?, ?)", id, string(data)); err != nil {
+			tx.Rollback()
+			return lxerrors.New("writing "+id+" to "+table, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return lxerrors.New("committing transaction on "+table, err)
+	}
+	return nil
+}
+
+// acquireLayerTx increments digest's Layer refcount inside tx, writing its
+// blob and creating the Layer row the first time digest is seen. It is the
+// sqlState counterpart of memoryState's acquireLayer.
+func acquireLayerTx(tx *sql.Tx, digest string, data []byte) error {
+	var existing string
+	err := tx.QueryRow("SELECT data FROM layers WHERE id = ?", digest).Scan(&existing)
+	if err != nil && err != sql.ErrNoRows {
+		return lxerrors.New("querying layer "+digest, err)
+	}
+	var layer Layer
+	if err == sql.ErrNoRows {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO blobs (digest, data) VALUES (?, ?)", digest, string(data)); err != nil {
+			return lxerrors.New("writing blob "+digest, err)
+		}
+		layer = Layer{Digest: digest, SizeMb: int64(len(data)) / (1024 * 1024)}
+	} else if err := json.Unmarshal([]byte(existing), &layer); err != nil {
+		return lxerrors.New("unmarshaling layer "+digest, err)
+	}
+	layer.RefCount++
+	marshaled, err := json.Marshal(&layer)
+	if err != nil {
+		return lxerrors.New("marshaling layer "+digest, err)
+	}
+	if _, err := tx.Exec("INSERT OR REPLACE INTO layers (id, data) VALUES (?, ?)", digest, string(marshaled)); err != nil {
+		return lxerrors.New("writing layer "+digest, err)
+	}
+	return nil
+}
+
+// releaseLayerTx decrements digest's Layer refcount inside tx, deleting the
+// blob and Layer row once nothing references it anymore. It is the
+// sqlState counterpart of memoryState's releaseLayer.
+func releaseLayerTx(tx *sql.Tx, digest string) error {
+	var existing string
+	err := tx.QueryRow("SELECT data FROM layers WHERE id = ?", digest).Scan(&existing)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return lxerrors.New("querying layer "+digest, err)
+	}
+	var layer Layer
+	if err := json.Unmarshal([]byte(existing), &layer); err != nil {
+		return lxerrors.New("unmarshaling layer "+digest, err)
+	}
+	layer.RefCount--
+	if layer.RefCount > 0 {
+		marshaled, err := json.Marshal(&layer)
+		if err != nil {
+			return lxerrors.New("marshaling layer "+digest, err)
+		}
+		if _, err := tx.Exec("UPDATE layers SET data = ? WHERE id = ?", string(marshaled), digest); err != nil {
+			return lxerrors.New("updating layer "+digest, err)
+		}
+		return nil
+	}
+	if _, err := tx.Exec("DELETE FROM layers WHERE id = ?", digest); err != nil {
+		return lxerrors.New("deleting layer "+digest, err)
+	}
+	if _, err := tx.Exec("DELETE FROM blobs WHERE digest = ?", digest); err != nil {
+		return lxerrors.New("deleting blob "+digest, err)
+	}
+	return nil
+}
+
+// ModifyImages reconciles the layers table against the DeviceMappings of
+// every image modify touches, in the same transaction that writes the
+// images table, so the SQL backend never observes an image row pointing at
+// a digest that has no matching layer.
+func (s *sqlState) ModifyImages(modify func(images map[string]*types.Image) error) error {
+	s.dbLock.Lock()
+	defer s.dbLock.Unlock()
+	before, err := s.getAll("images")
+	if err != nil {
+		return err
+	}
+	images := make(map[string]*types.Image)
+	beforeDigests := make(map[string]string, len(before))
+	for id, data := range before {
+		var record sqlImageRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return lxerrors.New("unmarshaling image "+id, err)
+		}
+		image, err := s.imageFromRecord(&record)
+		if err != nil {
+			return err
+		}
+		images[id] = image
+		beforeDigests[id] = record.LayerDigest
+	}
+	if err := modify(images); err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return lxerrors.New("beginning transaction on images", err)
+	}
+	for id := range before {
+		if _, ok := images[id]; ok {
+			continue
+		}
+		if _, err := tx.Exec("DELETE FROM images WHERE id = ?", id); err != nil {
+			tx.Rollback()
+			return lxerrors.New("deleting "+id+" from images", err)
+		}
+		if err := releaseLayerTx(tx, beforeDigests[id]); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for id, image := range images {
+		digest, data, err := hashDeviceMappings(image.DeviceMappings)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if oldDigest, ok := beforeDigests[id]; !ok || oldDigest != digest {
+			if err := acquireLayerTx(tx, digest, data); err != nil {
+				tx.Rollback()
+				return err
+			}
+			if ok {
+				if err := releaseLayerTx(tx, oldDigest); err != nil {
+					tx.Rollback()
+					return err
+				}
+			}
+		}
+		record := sqlImageRecord{
+			Id:             image.Id,
+			Name:           image.Name,
+			LayerDigest:    digest,
+			SizeMb:         image.SizeMb,
+			Infrastructure: image.Infrastructure,
+			Created:        image.Created,
+		}
+		if err := writeRowTx(tx, "images", id, &record); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return lxerrors.New("committing transaction on images", err)
+	}
+	return nil
+}
+
+func (s *sqlState) ModifyInstances(modify func(instances map[string]*types.Instance) error) error {
+	s.dbLock.Lock()
+	defer s.dbLock.Unlock()
+	before, err := s.getAll("instances")
+	if err != nil {
+		return err
+	}
+	instances := make(map[string]*types.Instance)
+	for id, data := range before {
+		var instance types.Instance
+		if err := json.Unmarshal(data, &instance); err != nil {
+			return lxerrors.New("unmarshaling instance "+id, err)
+		}
+		instances[id] = &instance
+	}
+	if err := modify(instances); err != nil {
+		return err
+	}
+	after := make(map[string]interface{})
+	for id, instance := range instances {
+		after[id] = instance
+	}
+	return modifyTable(s, "instances", before, after)
+}
+
+func (s *sqlState) ModifyVolumes(modify func(volumes map[string]*types.Volume) error) error {
+	s.dbLock.Lock()
+	defer s.dbLock.Unlock()
+	before, err := s.getAll("volumes")
+	if err != nil {
+		return err
+	}
+	volumes := make(map[string]*types.Volume)
+	for id, data := range before {
+		var volume types.Volume
+		if err := json.Unmarshal(data, &volume); err != nil {
+			return lxerrors.New("unmarshaling volume "+id, err)
+		}
+		volumes[id] = &volume
+	}
+	if err := modify(volumes); err != nil {
+		return err
+	}
+	after := make(map[string]interface{})
+	for id, volume := range volumes {
+		after[id] = volume
+	}
+	return modifyTable(s, "volumes", before, after)
+}
+
+// Save is a no-op for sqlState: every ModifyImages/ModifyInstances/ModifyVolumes
+// call already commits its change transactionally, so there is nothing left
+// to flush. It exists only to satisfy the State interface.
+func (s *sqlState) Save() error {
+	return nil
+}
+
+// Load is a no-op for sqlState: rows are read lazily by Get*/Modify*, so
+// there is no in-memory copy to hydrate. It exists only to satisfy the
+// State interface.
+func (s *sqlState) Load() error {
+	return nil
+}
+
+// MigrateMemoryStateToSQL reads an existing memoryState save directory at
+// saveDir and imports its Images/Instances/Volumes into a fresh sqlite3
+// database at dbPath, returning the resulting State. It is meant to be run
+// once when switching an existing unik install from the JSON-file backend
+// to the SQL backend.
+func MigrateMemoryStateToSQL(saveDir, dbPath string) (*sqlState, error) {
+	if _, err := os.Stat(saveDir); err != nil {
+		return nil, lxerrors.New("locating memory state save directory "+saveDir, err)
+	}
+	mem := NewMemoryState(saveDir)
+	if err := mem.Load(); err != nil {
+		return nil, lxerrors.New("loading memory state from "+saveDir, err)
+	}
+	sqlS, err := NewSQLState(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := sqlS.ModifyImages(func(images map[string]*types.Image) error {
+		for id, image := range mem.GetImages() {
+			images[id] = image
+		}
+		return nil
+	}); err != nil {
+		return nil, lxerrors.New("migrating images into sqlite", err)
+	}
+	if err := sqlS.ModifyInstances(func(instances map[string]*types.Instance) error {
+		for id, instance := range mem.GetInstances() {
+			instances[id] = instance
+		}
+		return nil
+	}); err != nil {
+		return nil, lxerrors.New("migrating instances into sqlite", err)
+	}
+	if err := sqlS.ModifyVolumes(func(volumes map[string]*types.Volume) error {
+		for id, volume := range mem.GetVolumes() {
+			volumes[id] = volume
+		}
+		return nil
+	}); err != nil {
+		return nil, lxerrors.New("migrating volumes into sqlite", err)
+	}
+	return sqlS, nil
+}
@@ -7,138 +7,576 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 type State interface {
 	GetImages() map[string]*types.Image
 	GetInstances() map[string]*types.Instance
 	GetVolumes() map[string]*types.Volume
+	GetLayers() map[string]*Layer
 	ModifyImages(modify func(images map[string]*types.Image) error) error
 	ModifyInstances(modify func(instances map[string]*types.Instance) error) error
 	ModifyVolumes(modify func(volumes map[string]*types.Volume) error) error
+	ModifyLayers(modify func(layers map[string]*Layer) error) error
+	RenameImage(id, newName string) error
+	RenameInstance(id, newName string) error
+	RenameVolume(id, newName string) error
 	Save() error
 	Load() error
 }
 
+// keyedMutex hands out a lock per key, so unrelated ids don't block each
+// other while still serializing operations on the same id. Entries are
+// refcounted and evicted once nothing is waiting on them, so the map
+// doesn't grow without bound over the life of a long-running daemon.
+type keyedMutex struct {
+	mapLock sync.Mutex
+	locks   map[string]*keyedMutexEntry
+}
+
+type keyedMutexEntry struct {
+	mu       sync.Mutex
+	refCount int
+}
+
+// lock acquires the lock for key, creating it on first use, and returns a
+// token that must be passed to unlock to release it.
+func (k *keyedMutex) lock(key string) *keyedMutexEntry {
+	k.mapLock.Lock()
+	if k.locks == nil {
+		k.locks = make(map[string]*keyedMutexEntry)
+	}
+	entry, ok := k.locks[key]
+	if !ok {
+		entry = &keyedMutexEntry{}
+		k.locks[key] = entry
+	}
+	entry.refCount++
+	k.mapLock.Unlock()
+
+	entry.mu.Lock()
+	return entry
+}
+
+// unlock releases the lock for key previously returned by lock, evicting
+// key's entry once no other caller still holds a reference to it.
+func (k *keyedMutex) unlock(key string, entry *keyedMutexEntry) {
+	entry.mu.Unlock()
+
+	k.mapLock.Lock()
+	defer k.mapLock.Unlock()
+	entry.refCount--
+	if entry.refCount == 0 {
+		delete(k.locks, key)
+	}
+}
+
+// memoryState keeps Images/Instances/Volumes/Layers behind atomic.Value so
+// Get* reads the current map with a lock-free atomic load, never blocking
+// on or blocked by a writer. Each Modify* instead takes a dedicated write
+// lock, builds a new map holding a fresh copy of every entry, lets the
+// caller mutate those copies - in place or by replacing them, either is
+// safe - and publishes the result with a single atomic Store. Because every
+// entry handed to modify is already a private copy, no concurrent reader
+// can ever observe a half-written value; dirty-tracking diffs the new map
+// against the old one by value rather than by pointer so an in-place
+// mutation is still detected as a change.
 type memoryState struct {
-	imagesLock    sync.RWMutex
-	instancesLock sync.RWMutex
-	volumesLock   sync.RWMutex
-	saveLock      sync.Mutex
-	saveFile      string
-	Images        map[string]*types.Image    `json:"Images"`
-	Instances     map[string]*types.Instance `json:"Instances"`
-	Volumes       map[string]*types.Volume   `json:"Volumes"`
+	imagesValue    atomic.Value
+	instancesValue atomic.Value
+	volumesValue   atomic.Value
+	layersValue    atomic.Value
+
+	imagesWriteLock    sync.Mutex
+	instancesWriteLock sync.Mutex
+	volumesWriteLock   sync.Mutex
+	layersWriteLock    sync.Mutex
+
+	saveLock  sync.Mutex
+	fileLocks keyedMutex
+	saveDir   string
+
+	imagesDirty    map[string]bool
+	instancesDirty map[string]bool
+	volumesDirty   map[string]bool
+	layersDirty    map[string]bool
+
+	// imageLayerDigests tracks which Layer digest each image id last
+	// reconciled against, so a changed or deleted image can release the
+	// layer it used to reference. It is rebuilt on Load and never persisted,
+	// since it is fully derivable from the current Images/Layers contents.
+	// Only touched while holding imagesWriteLock.
+	imageLayerDigests map[string]string
+}
+
+const (
+	imagesSubdir    = "images"
+	instancesSubdir = "instances"
+	volumesSubdir   = "volumes"
+)
+
+// imageRecord is the shape written to <saveDir>/images/<id>.json. It omits
+// DeviceMappings: that payload already lives once in the content-addressed
+// blob store, keyed by LayerDigest, so Load rehydrates it from there rather
+// than each image carrying its own copy on disk.
+type imageRecord struct {
+	Id             string
+	Name           string
+	LayerDigest    string
+	SizeMb         int64
+	Infrastructure string
+	Created        int64
+}
+
+func toImageRecord(image *types.Image, digest string) *imageRecord {
+	return &imageRecord{
+		Id:             image.Id,
+		Name:           image.Name,
+		LayerDigest:    digest,
+		SizeMb:         image.SizeMb,
+		Infrastructure: image.Infrastructure,
+		Created:        image.Created,
+	}
 }
 
-func NewMemoryState(saveFile string) *memoryState {
-	return &memoryState{
-		saveFile:      saveFile,
-		Images:        make(map[string]*types.Image),
-		Instances:     make(map[string]*types.Instance),
-		Volumes:       make(map[string]*types.Volume),
+// loadDeviceMappings reads digest's blob back from the CAS store and
+// unmarshals it into the DeviceMappings slice that was hashed to produce
+// it. An empty digest (an image that somehow never reconciled a layer)
+// yields nil rather than an error.
+func (s *memoryState) loadDeviceMappings(digest string) ([]types.DeviceMapping, error) {
+	if digest == "" {
+		return nil, nil
 	}
+	data, err := ioutil.ReadFile(s.blobPath(digest))
+	if err != nil {
+		return nil, lxerrors.New("reading blob "+digest, err)
+	}
+	var deviceMappings []types.DeviceMapping
+	if err := json.Unmarshal(data, &deviceMappings); err != nil {
+		return nil, lxerrors.New("unmarshaling device mappings for "+digest, err)
+	}
+	return deviceMappings, nil
+}
+
+func NewMemoryState(saveDir string) *memoryState {
+	s := &memoryState{
+		saveDir:           saveDir,
+		imagesDirty:       make(map[string]bool),
+		instancesDirty:    make(map[string]bool),
+		volumesDirty:      make(map[string]bool),
+		layersDirty:       make(map[string]bool),
+		imageLayerDigests: make(map[string]string),
+	}
+	s.imagesValue.Store(make(map[string]*types.Image))
+	s.instancesValue.Store(make(map[string]*types.Instance))
+	s.volumesValue.Store(make(map[string]*types.Volume))
+	s.layersValue.Store(make(map[string]*Layer))
+	return s
+}
+
+// getImagesRaw returns the currently published Images map as-is, sharing
+// its pointers with the published version. It exists only for internal
+// callers (Modify*, Save) that read the published map without mutating
+// it; anything that could hand the result to outside code must go through
+// GetImages instead.
+func (s *memoryState) getImagesRaw() map[string]*types.Image {
+	return s.imagesValue.Load().(map[string]*types.Image)
 }
 
+func (s *memoryState) getInstancesRaw() map[string]*types.Instance {
+	return s.instancesValue.Load().(map[string]*types.Instance)
+}
+
+func (s *memoryState) getVolumesRaw() map[string]*types.Volume {
+	return s.volumesValue.Load().(map[string]*types.Volume)
+}
+
+// copyImage returns a copy of image that shares no mutable state with it,
+// so a caller holding the copy can never mutate the original in place.
+func copyImage(image *types.Image) *types.Image {
+	copied := *image
+	if image.DeviceMappings != nil {
+		copied.DeviceMappings = append([]types.DeviceMapping(nil), image.DeviceMappings...)
+	}
+	return &copied
+}
+
+// GetImages returns a snapshot of the current images, each a fresh copy so
+// a caller mutating an entry in place can never corrupt the published
+// state or race with a concurrent reader.
 func (s *memoryState) GetImages() map[string]*types.Image {
-	s.imagesLock.RLock()
-	defer s.imagesLock.RUnlock()
-	imagesCopy := make(map[string]*types.Image)
-	for id, image := range s.Images {
-		imageCopy := &types.Image{
-			Id:             image.Id,
-			Name:           image.Name,
-			DeviceMappings: image.DeviceMappings,
-			SizeMb:         image.SizeMb,
-			Infrastructure: image.Infrastructure,
-			Created:        image.Created,
-		}
-		imagesCopy[id] = imageCopy
+	raw := s.getImagesRaw()
+	images := make(map[string]*types.Image, len(raw))
+	for id, image := range raw {
+		images[id] = copyImage(image)
 	}
-	return imagesCopy
+	return images
 }
 
 func (s *memoryState) GetInstances() map[string]*types.Instance {
-	s.instancesLock.RLock()
-	defer s.instancesLock.RUnlock()
-	instancesCopy := make(map[string]*types.Instance)
-	for id, instance := range s.Instances {
-		instanceCopy := &types.Instance{
-			Id:             instance.Id,
-			ImageId:        instance.ImageId,
-			Infrastructure: instance.Infrastructure,
-			Name:           instance.Name,
-			State:          instance.State,
-			Created:          instance.Created,
-		}
-		instancesCopy[id] = instanceCopy
+	raw := s.getInstancesRaw()
+	instances := make(map[string]*types.Instance, len(raw))
+	for id, instance := range raw {
+		copied := *instance
+		instances[id] = &copied
 	}
-	return instancesCopy
+	return instances
 }
 
 func (s *memoryState) GetVolumes() map[string]*types.Volume {
-	s.volumesLock.RLock()
-	defer s.volumesLock.RUnlock()
-	volumesCopy := make(map[string]*types.Volume)
-	for id, volume := range s.Volumes {
-		volumeCopy := &types.Volume{
-			Id:             volume.Id,
-			Name:           volume.Name,
-			SizeMb:         volume.SizeMb,
-			Attachment:     volume.Attachment,
-			Infrastructure: volume.Infrastructure,
-			Created: volume.Created,
+	raw := s.getVolumesRaw()
+	volumes := make(map[string]*types.Volume, len(raw))
+	for id, volume := range raw {
+		copied := *volume
+		volumes[id] = &copied
+	}
+	return volumes
+}
+
+// markDirtyImages compares before and after by value per id and flags only
+// ids that were added, removed, or whose contents actually differ, so Save
+// only rewrites entities that could have changed since the last save
+// rather than everything that merely still exists. It compares by value
+// rather than by pointer because ModifyImages now hands the caller its own
+// copy of every entry - a caller mutating that copy in place, instead of
+// replacing the map entry, still needs to be detected as dirty.
+func markDirtyImages(dirty map[string]bool, before, after map[string]*types.Image) {
+	for id, image := range before {
+		other, ok := after[id]
+		if !ok || !reflect.DeepEqual(image, other) {
+			dirty[id] = true
+		}
+	}
+	for id, image := range after {
+		other, ok := before[id]
+		if !ok || !reflect.DeepEqual(image, other) {
+			dirty[id] = true
+		}
+	}
+}
+
+func markDirtyInstances(dirty map[string]bool, before, after map[string]*types.Instance) {
+	for id, instance := range before {
+		other, ok := after[id]
+		if !ok || *instance != *other {
+			dirty[id] = true
+		}
+	}
+	for id, instance := range after {
+		other, ok := before[id]
+		if !ok || *instance != *other {
+			dirty[id] = true
+		}
+	}
+}
+
+func markDirtyVolumes(dirty map[string]bool, before, after map[string]*types.Volume) {
+	for id, volume := range before {
+		other, ok := after[id]
+		if !ok || *volume != *other {
+			dirty[id] = true
+		}
+	}
+	for id, volume := range after {
+		other, ok := before[id]
+		if !ok || *volume != *other {
+			dirty[id] = true
 		}
-		volumesCopy[id] = volumeCopy
 	}
-	return volumesCopy
 }
 
 func (s *memoryState) ModifyImages(modify func(images map[string]*types.Image) error) error {
-	s.imagesLock.Lock()
-	defer s.imagesLock.Unlock()
-	return modify(s.Images)
+	s.imagesWriteLock.Lock()
+	defer s.imagesWriteLock.Unlock()
+
+	before := s.getImagesRaw()
+	next := make(map[string]*types.Image, len(before))
+	for id, image := range before {
+		// Hand modify its own copy of every entry, never the published
+		// pointer, so a caller that mutates an entry in place - instead of
+		// replacing it, the documented idiom - can't corrupt what a
+		// concurrent GetImages is reading right now. markDirtyImages then
+		// diffs by value, since next[id] is never the same pointer as
+		// before[id] even when nothing actually changed.
+		next[id] = copyImage(image)
+	}
+	if err := modify(next); err != nil {
+		return err
+	}
+	s.imagesValue.Store(next)
+	markDirtyImages(s.imagesDirty, before, next)
+	// Deduplicate device mapping payloads into the layer store, and release
+	// the layer any deleted or changed image used to reference.
+	return s.reconcileImageLayers(next)
 }
 
 func (s *memoryState) ModifyInstances(modify func(instances map[string]*types.Instance) error) error {
-	s.instancesLock.Lock()
-	defer s.instancesLock.Unlock()
-	return modify(s.Instances)
+	s.instancesWriteLock.Lock()
+	defer s.instancesWriteLock.Unlock()
+
+	before := s.getInstancesRaw()
+	next := make(map[string]*types.Instance, len(before))
+	for id, instance := range before {
+		copied := *instance
+		next[id] = &copied
+	}
+	if err := modify(next); err != nil {
+		return err
+	}
+	s.instancesValue.Store(next)
+	markDirtyInstances(s.instancesDirty, before, next)
+	return nil
 }
 
 func (s *memoryState) ModifyVolumes(modify func(volumes map[string]*types.Volume) error) error {
-	s.volumesLock.Lock()
-	defer s.volumesLock.Unlock()
-	return modify(s.Volumes)
+	s.volumesWriteLock.Lock()
+	defer s.volumesWriteLock.Unlock()
+
+	before := s.getVolumesRaw()
+	next := make(map[string]*types.Volume, len(before))
+	for id, volume := range before {
+		copied := *volume
+		next[id] = &copied
+	}
+	if err := modify(next); err != nil {
+		return err
+	}
+	s.volumesValue.Store(next)
+	markDirtyVolumes(s.volumesDirty, before, next)
+	return nil
+}
+
+func entityFile(saveDir, subdir, id string) string {
+	return filepath.Join(saveDir, subdir, id+".json")
+}
+
+// saveEntity writes entity's json under its own per-id lock, or removes the
+// file if entity is nil (the id was deleted).
+func (s *memoryState) saveEntity(subdir, id string, entity interface{}) error {
+	key := subdir + "/" + id
+	entry := s.fileLocks.lock(key)
+	defer s.fileLocks.unlock(key, entry)
+
+	path := entityFile(s.saveDir, subdir, id)
+	if entity == nil {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return lxerrors.New("removing "+path, err)
+		}
+		return nil
+	}
+	data, err := json.Marshal(entity)
+	if err != nil {
+		return lxerrors.New("marshaling "+path, err)
+	}
+	os.MkdirAll(filepath.Dir(path), 0751)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return lxerrors.New("writing "+path, err)
+	}
+	return nil
 }
 
+// Save rewrites only the entities whose id was touched by a Modify* call
+// since the last Save, each under its own per-id file lock. saveLock keeps
+// concurrent Save() calls from racing over the same dirty sets; draining a
+// dirty set briefly takes that type's write lock, so Save contends with
+// writers the same way a writer would, but readers are never blocked.
 func (s *memoryState) Save() error {
 	s.saveLock.Lock()
 	defer s.saveLock.Unlock()
-	data, err := json.Marshal(s)
-	if err != nil {
-		return lxerrors.New("failed to marshal memory state to json", err)
+
+	if _, err := os.Stat(filepath.Join(s.saveDir, schemaVersionFile)); os.IsNotExist(err) {
+		if err := writeSchemaVersion(s.saveDir, currentSchemaVersion); err != nil {
+			return err
+		}
+	}
+
+	s.imagesWriteLock.Lock()
+	dirtyImages := s.imagesDirty
+	s.imagesDirty = make(map[string]bool)
+	images := s.getImagesRaw()
+	imageLayerDigests := make(map[string]string, len(s.imageLayerDigests))
+	for id, digest := range s.imageLayerDigests {
+		imageLayerDigests[id] = digest
+	}
+	s.imagesWriteLock.Unlock()
+	for id := range dirtyImages {
+		image, ok := images[id]
+		if !ok {
+			if err := s.saveEntity(imagesSubdir, id, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := s.saveEntity(imagesSubdir, id, toImageRecord(image, imageLayerDigests[id])); err != nil {
+			return err
+		}
+	}
+
+	s.instancesWriteLock.Lock()
+	dirtyInstances := s.instancesDirty
+	s.instancesDirty = make(map[string]bool)
+	instances := s.getInstancesRaw()
+	s.instancesWriteLock.Unlock()
+	for id := range dirtyInstances {
+		instance, ok := instances[id]
+		if !ok {
+			if err := s.saveEntity(instancesSubdir, id, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := s.saveEntity(instancesSubdir, id, instance); err != nil {
+			return err
+		}
 	}
-	os.MkdirAll(filepath.Dir(s.saveFile), 0751)
-	err = ioutil.WriteFile(s.saveFile, data, 0644)
+
+	s.volumesWriteLock.Lock()
+	dirtyVolumes := s.volumesDirty
+	s.volumesDirty = make(map[string]bool)
+	volumes := s.getVolumesRaw()
+	s.volumesWriteLock.Unlock()
+	for id := range dirtyVolumes {
+		volume, ok := volumes[id]
+		if !ok {
+			if err := s.saveEntity(volumesSubdir, id, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := s.saveEntity(volumesSubdir, id, volume); err != nil {
+			return err
+		}
+	}
+
+	s.layersWriteLock.Lock()
+	dirtyLayers := s.layersDirty
+	s.layersDirty = make(map[string]bool)
+	layers := s.getLayersRaw()
+	s.layersWriteLock.Unlock()
+	for digest := range dirtyLayers {
+		layer, ok := layers[digest]
+		if !ok {
+			if err := s.saveEntity(layersSubdir, digest, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := s.saveEntity(layersSubdir, digest, layer); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadDir walks <saveDir>/<subdir> and unmarshals each <id>.json file,
+// calling unmarshalInto for each one found.
+func loadDir(saveDir, subdir string, unmarshalInto func(id string, data []byte) error) error {
+	dir := filepath.Join(saveDir, subdir)
+	infos, err := ioutil.ReadDir(dir)
 	if err != nil {
-		return lxerrors.New("writing save file "+s.saveFile, err)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return lxerrors.New("reading "+dir, err)
+	}
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), ".json") {
+			continue
+		}
+		id := strings.TrimSuffix(info.Name(), ".json")
+		data, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+		if err != nil {
+			return lxerrors.New("reading "+info.Name(), err)
+		}
+		if err := unmarshalInto(id, data); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// Load rebuilds the in-memory maps by walking <saveDir>/images,
+// <saveDir>/instances, <saveDir>/volumes and <saveDir>/layers. Each file is
+// first brought up to currentSchemaVersion via the registered migration
+// chains, so a save directory written by an older build never silently
+// corrupts or drops data.
 func (s *memoryState) Load() error {
-	data, err := ioutil.ReadFile(s.saveFile)
+	fromVersion, err := readSchemaVersion(s.saveDir)
 	if err != nil {
-		return lxerrors.New("error reading save file "+s.saveFile, err)
+		return err
 	}
-	var newS memoryState
-	err = json.Unmarshal(data, &newS)
-	if err != nil {
-		return lxerrors.New("failed to unmarshal data "+string(data)+" to memory state", err)
+
+	images := make(map[string]*types.Image)
+	imageLayerDigests := make(map[string]string)
+	if err := loadDirMigrated(s.saveDir, imagesSubdir, fromVersion, imageMigrations, func(id string, data []byte) error {
+		var record imageRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return lxerrors.New("unmarshaling image "+id, err)
+		}
+		deviceMappings, err := s.loadDeviceMappings(record.LayerDigest)
+		if err != nil {
+			return err
+		}
+		images[id] = &types.Image{
+			Id:             record.Id,
+			Name:           record.Name,
+			DeviceMappings: deviceMappings,
+			SizeMb:         record.SizeMb,
+			Infrastructure: record.Infrastructure,
+			Created:        record.Created,
+		}
+		imageLayerDigests[id] = record.LayerDigest
+		return nil
+	}); err != nil {
+		return err
 	}
-	newS.saveFile = s.saveFile
-	*s = newS
-	return nil
+
+	instances := make(map[string]*types.Instance)
+	if err := loadDirMigrated(s.saveDir, instancesSubdir, fromVersion, instanceMigrations, func(id string, data []byte) error {
+		var instance types.Instance
+		if err := json.Unmarshal(data, &instance); err != nil {
+			return lxerrors.New("unmarshaling instance "+id, err)
+		}
+		instances[id] = &instance
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	volumes := make(map[string]*types.Volume)
+	if err := loadDirMigrated(s.saveDir, volumesSubdir, fromVersion, volumeMigrations, func(id string, data []byte) error {
+		var volume types.Volume
+		if err := json.Unmarshal(data, &volume); err != nil {
+			return lxerrors.New("unmarshaling volume "+id, err)
+		}
+		volumes[id] = &volume
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	layers := make(map[string]*Layer)
+	if err := loadDirMigrated(s.saveDir, layersSubdir, fromVersion, layerMigrations, func(digest string, data []byte) error {
+		var layer Layer
+		if err := json.Unmarshal(data, &layer); err != nil {
+			return lxerrors.New("unmarshaling layer "+digest, err)
+		}
+		layers[digest] = &layer
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	s.imagesValue.Store(images)
+	s.instancesValue.Store(instances)
+	s.volumesValue.Store(volumes)
+	s.layersValue.Store(layers)
+	s.imageLayerDigests = imageLayerDigests
+
+	return writeSchemaVersion(s.saveDir, currentSchemaVersion)
 }
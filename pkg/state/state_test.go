@@ -0,0 +1,170 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/emc-advanced-dev/unik/pkg/types"
+)
+
+func TestMarkDirtyImagesOnlyFlagsChangedIds(t *testing.T) {
+	dirty := make(map[string]bool)
+	unchanged := &types.Image{Id: "unchanged"}
+	before := map[string]*types.Image{
+		"unchanged": unchanged,
+		"removed":   {Id: "removed"},
+	}
+	after := map[string]*types.Image{
+		"unchanged": unchanged,
+		"added":     {Id: "added"},
+	}
+
+	markDirtyImages(dirty, before, after)
+
+	if dirty["unchanged"] {
+		t.Fatalf("unchanged id was marked dirty")
+	}
+	if !dirty["removed"] {
+		t.Fatalf("removed id was not marked dirty")
+	}
+	if !dirty["added"] {
+		t.Fatalf("added id was not marked dirty")
+	}
+}
+
+func TestModifyImagesDoesNotMarkUntouchedIdsDirty(t *testing.T) {
+	saveDir, err := ioutil.TempDir("", "unik-state")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(saveDir)
+
+	s := NewMemoryState(saveDir)
+	if err := s.ModifyImages(func(images map[string]*types.Image) error {
+		images["a"] = &types.Image{Id: "a", Name: "a"}
+		images["b"] = &types.Image{Id: "b", Name: "b"}
+		return nil
+	}); err != nil {
+		t.Fatalf("seeding images: %v", err)
+	}
+	s.imagesDirty = make(map[string]bool)
+
+	if err := s.ModifyImages(func(images map[string]*types.Image) error {
+		images["a"].Name = "a"
+		return nil
+	}); err != nil {
+		t.Fatalf("no-op modify: %v", err)
+	}
+
+	if len(s.imagesDirty) != 0 {
+		t.Fatalf("expected no ids marked dirty by a no-op modify, got %v", s.imagesDirty)
+	}
+}
+
+// TestModifyImagesInPlaceMutationSurvivesSaveAndLoad reproduces a caller
+// using the old memoryState idiom of mutating an entry in place
+// (images["a"].Name = "x") instead of replacing the map entry. Dirty
+// tracking must still pick it up, or the change is silently lost the next
+// time Save/Load round-trip the store.
+func TestModifyImagesInPlaceMutationSurvivesSaveAndLoad(t *testing.T) {
+	saveDir, err := ioutil.TempDir("", "unik-state")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(saveDir)
+
+	s := NewMemoryState(saveDir)
+	if err := s.ModifyImages(func(images map[string]*types.Image) error {
+		images["a"] = &types.Image{Id: "a", Name: "old-name"}
+		return nil
+	}); err != nil {
+		t.Fatalf("seeding images: %v", err)
+	}
+	if err := s.Save(); err != nil {
+		t.Fatalf("initial Save: %v", err)
+	}
+
+	if err := s.ModifyImages(func(images map[string]*types.Image) error {
+		images["a"].Name = "new-name"
+		return nil
+	}); err != nil {
+		t.Fatalf("in-place rename: %v", err)
+	}
+	if s.GetImages()["a"].Name != "new-name" {
+		t.Fatalf("in-place rename did not take effect in memory")
+	}
+
+	if err := s.Save(); err != nil {
+		t.Fatalf("Save after in-place rename: %v", err)
+	}
+
+	reloaded := NewMemoryState(saveDir)
+	if err := reloaded.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if reloaded.GetImages()["a"].Name != "new-name" {
+		t.Fatalf("in-place rename did not survive Save+Load, got %q", reloaded.GetImages()["a"].Name)
+	}
+}
+
+func TestGetImagesReturnsDefensiveCopies(t *testing.T) {
+	saveDir, err := ioutil.TempDir("", "unik-state")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(saveDir)
+
+	s := NewMemoryState(saveDir)
+	if err := s.ModifyImages(func(images map[string]*types.Image) error {
+		images["a"] = &types.Image{Id: "a", Name: "original"}
+		return nil
+	}); err != nil {
+		t.Fatalf("seeding images: %v", err)
+	}
+
+	got := s.GetImages()
+	got["a"].Name = "mutated"
+
+	if s.GetImages()["a"].Name != "original" {
+		t.Fatalf("mutating a GetImages result leaked into published state")
+	}
+}
+
+func TestGetImagesDeepCopiesDeviceMappings(t *testing.T) {
+	saveDir, err := ioutil.TempDir("", "unik-state")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(saveDir)
+
+	s := NewMemoryState(saveDir)
+	if err := s.ModifyImages(func(images map[string]*types.Image) error {
+		images["a"] = &types.Image{
+			Id:             "a",
+			DeviceMappings: []types.DeviceMapping{{MountPoint: "/", Path: "/dev/sda"}},
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("seeding images: %v", err)
+	}
+
+	got := s.GetImages()
+	got["a"].DeviceMappings[0].Path = "/dev/sdb"
+
+	if s.GetImages()["a"].DeviceMappings[0].Path != "/dev/sda" {
+		t.Fatalf("mutating a GetImages result's DeviceMappings leaked into published state")
+	}
+}
+
+func TestKeyedMutexEvictsEntryOnceUnreferenced(t *testing.T) {
+	var k keyedMutex
+	entry := k.lock("key")
+	k.unlock("key", entry)
+
+	k.mapLock.Lock()
+	defer k.mapLock.Unlock()
+	if _, ok := k.locks["key"]; ok {
+		t.Fatalf("entry for key was not evicted after unlock")
+	}
+}